@@ -0,0 +1,325 @@
+package libnetwork
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/resolvconf"
+	"github.com/miekg/dns"
+)
+
+const (
+	// resolverIPSandbox is the IP inside the sandbox that the resolver listens on.
+	resolverIPSandbox = "127.0.0.11"
+	dnsPort           = "53"
+	ptrIPv4domain     = "in-addr.arpa."
+	respTTL           = 600
+	// maxExtDNS is the number of upstream resolvers that can be configured for a sandbox.
+	maxExtDNS    = 3
+	extIOTimeout = 4 * time.Second
+)
+
+// Resolver is the embedded DNS server that every sandbox with service
+// discovery enabled runs on 127.0.0.11. Drivers register and deregister
+// container/service records as endpoints join and leave, and unresolved
+// queries are proxied to the host's upstream nameservers.
+type Resolver interface {
+	// Start starts the name server for the sandbox. It must bind and own
+	// the 127.0.0.11:53 socket inside the sandbox's network namespace
+	// itself: libnetwork only installs the iptables redirect rule that
+	// sends traffic there, it does not open the socket on the
+	// implementation's behalf.
+	Start() error
+	// Stop stops the name server for the sandbox.
+	Stop()
+	// SetExtServers sets the external nameservers that the resolver should
+	// proxy to on a miss against the sandbox's own service records.
+	SetExtServers([]string)
+	// NameLookup resolves a name query of the given type using the
+	// sandbox's service records, falling back to the external servers.
+	NameLookup(name string, qtype uint16) ([]string, error)
+}
+
+type extDNSEntry struct {
+	ipStr string
+}
+
+// resolver implements the Resolver interface backed by an in-process DNS
+// server bound inside the sandbox's network namespace.
+type resolver struct {
+	sb         *sandbox
+	extDNSList [maxExtDNS]extDNSEntry
+	server     *dns.Server
+	tcpServer  *dns.Server
+	err        error
+	sync.Mutex
+}
+
+// NewResolver creates a new embedded DNS resolver for sb, listening on
+// resolverIPSandbox:53 over both UDP and TCP.
+func NewResolver(sb *sandbox) Resolver {
+	return &resolver{sb: sb}
+}
+
+// Start starts the name server on 127.0.0.11:53 inside the sandbox's netns.
+func (r *resolver) Start() error {
+	r.Lock()
+	defer r.Unlock()
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", r.handleQuery)
+
+	// The listening sockets must be bound from inside the sandbox's own
+	// network namespace, not the daemon's: resolverIPSandbox only exists
+	// on the loopback interface created inside the sandbox, and binding
+	// from the calling goroutine's (host) namespace would both fail to
+	// receive any redirected traffic and collide with another sandbox
+	// that also wants 127.0.0.11:53.
+	var (
+		udpConn   net.PacketConn
+		tcpListen net.Listener
+		bindErr   error
+	)
+	err := r.sb.osSbox.InvokeFunc(func() {
+		udpConn, bindErr = net.ListenPacket("udp", net.JoinHostPort(resolverIPSandbox, dnsPort))
+		if bindErr != nil {
+			return
+		}
+		tcpListen, bindErr = net.Listen("tcp", net.JoinHostPort(resolverIPSandbox, dnsPort))
+		if bindErr != nil {
+			udpConn.Close()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error entering sandbox network namespace to bind name server sockets: %v", err)
+	}
+	if bindErr != nil {
+		return fmt.Errorf("error in opening name server socket: %v", bindErr)
+	}
+
+	r.server = &dns.Server{Handler: mux, PacketConn: udpConn}
+	r.tcpServer = &dns.Server{Handler: mux, Listener: tcpListen}
+
+	go func() {
+		if err := r.server.ActivateAndServe(); err != nil {
+			log.Errorf("error in udp server: %v", err)
+		}
+	}()
+	go func() {
+		if err := r.tcpServer.ActivateAndServe(); err != nil {
+			log.Errorf("error in tcp server: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop tears down the embedded resolver's listeners.
+func (r *resolver) Stop() {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.server != nil {
+		r.server.Shutdown()
+	}
+	if r.tcpServer != nil {
+		r.tcpServer.Shutdown()
+	}
+	r.server = nil
+	r.tcpServer = nil
+}
+
+// SetExtServers records the host's upstream nameservers to proxy to on miss.
+func (r *resolver) SetExtServers(servers []string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for i := range r.extDNSList {
+		r.extDNSList[i].ipStr = ""
+	}
+
+	l := len(servers)
+	if l > maxExtDNS {
+		l = maxExtDNS
+	}
+	for i := 0; i < l; i++ {
+		r.extDNSList[i].ipStr = servers[i]
+	}
+}
+
+// extServers returns the upstream nameservers currently configured, for
+// persisting alongside the rest of the sandbox's durable state.
+func (r *resolver) extServers() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var servers []string
+	for _, e := range r.extDNSList {
+		if e.ipStr != "" {
+			servers = append(servers, e.ipStr)
+		}
+	}
+	return servers
+}
+
+// NameLookup first tries to resolve name against the sandbox's own service
+// and endpoint records, then falls back to the external nameservers.
+func (r *resolver) NameLookup(name string, qtype uint16) ([]string, error) {
+	if ia, ok := r.sb.resolveName(name, qtype); ok {
+		return ia, nil
+	}
+
+	return r.forwardExtDNS(name, qtype)
+}
+
+// errNXDomain reports that an upstream nameserver gave a definitive,
+// authoritative answer that name does not exist, as distinct from the
+// upstream being unreachable or timing out. Callers should relay this to
+// the client as NXDOMAIN rather than SERVFAIL.
+type errNXDomain struct {
+	name string
+}
+
+func (e errNXDomain) Error() string {
+	return fmt.Sprintf("no such host %s", e.name)
+}
+
+func (r *resolver) forwardExtDNS(name string, qtype uint16) ([]string, error) {
+	r.Lock()
+	extServers := r.extDNSList
+	r.Unlock()
+
+	var lastErr error
+	for _, s := range extServers {
+		if s.ipStr == "" {
+			continue
+		}
+
+		exchange := new(dns.Msg)
+		exchange.SetQuestion(dns.Fqdn(name), qtype)
+
+		c := new(dns.Client)
+		c.Timeout = extIOTimeout
+		resp, _, err := c.Exchange(exchange, net.JoinHostPort(s.ipStr, dnsPort))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.Rcode == dns.RcodeNameError {
+			// The upstream server authoritatively answered that the name
+			// doesn't exist; that's a definitive answer, not a failure,
+			// so don't keep trying the remaining upstreams.
+			return nil, errNXDomain{name: name}
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("upstream %s returned rcode %d for %s", s.ipStr, resp.Rcode, name)
+			continue
+		}
+
+		var addrs []string
+		for _, a := range resp.Answer {
+			switch rr := a.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			case *dns.PTR:
+				addrs = append(addrs, rr.Ptr)
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no answer from upstream nameservers for %s", name)
+}
+
+// handleQuery answers A/AAAA/PTR queries out of the sandbox's service
+// records first, proxying to the external nameservers on a miss. An
+// upstream NXDOMAIN is relayed as NXDOMAIN, and SERVFAIL is returned once
+// every upstream has failed; an upstream reply that carries no A, AAAA or
+// PTR record (for example the answer to a query of another type) counts as
+// a failure too, so such queries also get SERVFAIL.
+func (r *resolver) handleQuery(w dns.ResponseWriter, query *dns.Msg) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			if len(query.Question) > 0 {
+				log.Errorf("error handling DNS query for %s: %v", query.Question[0].Name, err)
+			} else {
+				log.Errorf("error handling DNS query with no question: %v", err)
+			}
+
+			resp := new(dns.Msg)
+			var nxErr errNXDomain
+			if errors.As(err, &nxErr) {
+				resp.SetRcode(query, dns.RcodeNameError)
+			} else {
+				resp.SetRcode(query, dns.RcodeServerFailure)
+			}
+			w.WriteMsg(resp)
+		}
+	}()
+
+	if len(query.Question) == 0 {
+		err = fmt.Errorf("empty DNS question")
+		return
+	}
+
+	q := query.Question[0]
+	addrs, lookupErr := r.NameLookup(q.Name, q.Qtype)
+	if lookupErr != nil {
+		err = lookupErr
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Authoritative = true
+
+	for _, a := range addrs {
+		var rr dns.RR
+		switch q.Qtype {
+		case dns.TypeA:
+			ip := net.ParseIP(a).To4()
+			if ip == nil {
+				continue
+			}
+			rr = &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: respTTL}, A: ip}
+		case dns.TypeAAAA:
+			ip := net.ParseIP(a)
+			if ip == nil || ip.To4() != nil {
+				continue
+			}
+			rr = &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: respTTL}, AAAA: ip}
+		case dns.TypePTR:
+			rr = &dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: respTTL}, Ptr: dns.Fqdn(a)}
+		default:
+			continue
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	w.WriteMsg(resp)
+}
+
+// upstreamServers returns the host's real upstream nameservers, captured
+// before resolv.conf inside the sandbox is rewritten to point at
+// resolverIPSandbox.
+func upstreamServers() ([]string, error) {
+	rc, err := resolvconf.Get()
+	if err != nil {
+		return nil, err
+	}
+	return resolvconf.GetNameservers(rc), nil
+}
@@ -14,9 +14,11 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/libnetwork/etchosts"
+	"github.com/docker/libnetwork/iptables"
 	"github.com/docker/libnetwork/osl"
 	"github.com/docker/libnetwork/resolvconf"
 	"github.com/docker/libnetwork/types"
+	"github.com/miekg/dns"
 )
 
 // Sandbox provides the control over the network container entity. It is a one to one mapping with the container.
@@ -59,6 +61,8 @@ type sandbox struct {
 	refCnt      int
 	endpoints   epHeap
 	epPriority  map[string]int
+	resolver    Resolver
+	dnsRecords  map[string][]string
 	//hostsPath      string
 	//resolvConfPath string
 	joinLeaveDone chan struct{}
@@ -67,12 +71,13 @@ type sandbox struct {
 
 // These are the container configs used to customize container /etc/hosts file.
 type hostsPathConfig struct {
-	hostName        string
-	domainName      string
-	hostsPath       string
-	originHostsPath string
-	extraHosts      []extraHost
-	parentUpdates   []parentUpdate
+	hostName          string
+	domainName        string
+	hostsPath         string
+	hostsPathHashFile string
+	originHostsPath   string
+	extraHosts        []extraHost
+	parentUpdates     []parentUpdate
 }
 
 type parentUpdate struct {
@@ -93,6 +98,7 @@ type resolvConfPathConfig struct {
 	resolvConfHashFile   string
 	dnsList              []string
 	dnsSearchList        []string
+	dnsOptionsList       []string
 }
 
 type containerConfig struct {
@@ -155,10 +161,22 @@ func (sb *sandbox) Delete() error {
 		}
 	}
 
+	sb.Lock()
+	resolver := sb.resolver
+	sb.resolver = nil
+	sb.Unlock()
+	if resolver != nil {
+		resolver.Stop()
+	}
+
 	if sb.osSbox != nil {
 		sb.osSbox.Destroy()
 	}
 
+	if err := sb.deleteStoreState(); err != nil {
+		log.Warnf("Failed to delete store state of sandbox %s: %v", sb.ID(), err)
+	}
+
 	c.Lock()
 	delete(c.sandboxes, sb.ID())
 	c.Unlock()
@@ -247,6 +265,10 @@ func (sb *sandbox) populateNetworkResources(ep *endpoint) error {
 		}
 	}
 
+	if err := sb.storeUpdate(); err != nil {
+		log.Warnf("Failed to update the store state of sandbox %s: %v", sb.ID(), err)
+	}
+
 	return nil
 }
 
@@ -303,6 +325,10 @@ func (sb *sandbox) clearNetworkResources(ep *endpoint) error {
 		sb.updateGateway(highEpAfter)
 	}
 
+	if err := sb.storeUpdate(); err != nil {
+		log.Warnf("Failed to update the store state of sandbox %s: %v", sb.ID(), err)
+	}
+
 	return nil
 }
 
@@ -315,6 +341,7 @@ func (sb *sandbox) buildHostsFile() error {
 	if sb.config.hostsPath == "" {
 		sb.config.hostsPath = defaultPrefix + "/" + sb.id + "/hosts"
 	}
+	sb.config.hostsPathHashFile = sb.config.hostsPath + ".hash"
 
 	dir, _ := filepath.Split(sb.config.hostsPath)
 	if err := createBasePath(dir); err != nil {
@@ -334,7 +361,9 @@ func (sb *sandbox) buildHostsFile() error {
 		extraContent = append(extraContent, etchosts.Record{Hosts: extraHost.name, IP: extraHost.IP})
 	}
 
-	return etchosts.Build(sb.config.hostsPath, "", sb.config.hostName, sb.config.domainName, extraContent)
+	return sb.writeHostsFile(func(path string) error {
+		return etchosts.Build(path, "", sb.config.hostName, sb.config.domainName, extraContent)
+	})
 }
 
 func (sb *sandbox) updateHostsFile(ifaceIP string, svcRecords []etchosts.Record) error {
@@ -349,17 +378,194 @@ func (sb *sandbox) updateHostsFile(ifaceIP string, svcRecords []etchosts.Record)
 		extraContent = append(extraContent, svc)
 	}
 
-	return etchosts.Build(sb.config.hostsPath, ifaceIP, sb.config.hostName, sb.config.domainName, extraContent)
+	sb.updateDNSRecords(svcRecords)
+
+	return sb.writeHostsFile(func(path string) error {
+		return etchosts.Build(path, ifaceIP, sb.config.hostName, sb.config.domainName, extraContent)
+	})
+}
+
+// writeHostsFile regenerates /etc/hosts for the sandbox by invoking
+// generate against a tempfile in the same directory and renaming it over
+// the real path, so a reader inside the container never observes a torn
+// file. Before writing, it compares the hash of the file on disk against
+// the hash recorded after our last automated write, the same way
+// updateDNS guards resolv.conf; if the container has edited the file in
+// the meantime, the update is skipped.
+func (sb *sandbox) writeHostsFile(generate func(path string) error) error {
+	hashFile := sb.config.hostsPathHashFile
+
+	edited, err := hostsFileUserEdited(sb.config.hostsPath, hashFile)
+	if err != nil {
+		return err
+	}
+	if edited {
+		log.Infof("Skipping update of hosts file for sandbox %s because file was touched by user", sb.ID())
+		return nil
+	}
+
+	dir := path.Dir(sb.config.hostsPath)
+	tmpFile, err := ioutil.TempFile(dir, "hosts")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	if err := generate(tmpPath); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	hash, err := ioutils.HashData(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, filePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, sb.config.hostsPath); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(hashFile, []byte(hash), filePerm)
+}
+
+// hostsFileUserEdited reports whether the hosts file at hostsPath has
+// changed since the hash recorded in hashFile, i.e. whether the container
+// has edited it out from under us.
+func hostsFileUserEdited(hostsPath, hashFile string) (bool, error) {
+	content, err := ioutil.ReadFile(hostsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	oldHash, err := ioutil.ReadFile(hashFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		oldHash = []byte{}
+	}
+	if len(oldHash) == 0 {
+		return false, nil
+	}
+
+	curHash, err := ioutils.HashData(bytes.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+
+	return curHash != string(oldHash), nil
+}
+
+// updateDNSRecords refreshes the resolver's in-memory view of the service
+// and endpoint names reachable from this sandbox, so that the embedded DNS
+// server can answer queries without a round trip to an upstream resolver.
+func (sb *sandbox) updateDNSRecords(svcRecords []etchosts.Record) {
+	sb.Lock()
+	if sb.dnsRecords == nil {
+		sb.dnsRecords = make(map[string][]string)
+	}
+	for _, svc := range svcRecords {
+		name := dns.Fqdn(svc.Hosts)
+		sb.dnsRecords[name] = append(sb.dnsRecords[name], svc.IP)
+	}
+	sb.Unlock()
+}
+
+// removeDNSRecords drops the given service/endpoint records from the
+// resolver's in-memory view, mirroring deleteHostsEntries so a name stops
+// resolving as soon as the container backing it leaves.
+func (sb *sandbox) removeDNSRecords(svcRecords []etchosts.Record) {
+	sb.Lock()
+	defer sb.Unlock()
+
+	for _, svc := range svcRecords {
+		name := dns.Fqdn(svc.Hosts)
+		ips := sb.dnsRecords[name]
+		for i, ip := range ips {
+			if ip == svc.IP {
+				ips = append(ips[:i], ips[i+1:]...)
+				break
+			}
+		}
+		if len(ips) == 0 {
+			delete(sb.dnsRecords, name)
+		} else {
+			sb.dnsRecords[name] = ips
+		}
+	}
+}
+
+// resolveName answers an A/AAAA/PTR query from the sandbox's own service
+// and endpoint records, which is the same data backing updateHostsFile.
+func (sb *sandbox) resolveName(name string, qtype uint16) ([]string, bool) {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA && qtype != dns.TypePTR {
+		return nil, false
+	}
+
+	sb.Lock()
+	defer sb.Unlock()
+
+	if qtype == dns.TypePTR {
+		// Map the in-addr.arpa name back to an IPv4 address and return
+		// every name recorded for it.
+		labels := dns.SplitDomainName(name)
+		if len(labels) != 6 || !dns.IsSubDomain(ptrIPv4domain, dns.Fqdn(name)) {
+			return nil, false
+		}
+		ip := fmt.Sprintf("%s.%s.%s.%s", labels[3], labels[2], labels[1], labels[0])
+		var names []string
+		for n, addrs := range sb.dnsRecords {
+			for _, a := range addrs {
+				if a == ip {
+					names = append(names, n)
+				}
+			}
+		}
+		return names, len(names) > 0
+	}
+
+	ips, ok := sb.dnsRecords[dns.Fqdn(name)]
+	if !ok || len(ips) == 0 {
+		return nil, false
+	}
+	return ips, true
 }
 
 func (sb *sandbox) addHostsEntries(recs []etchosts.Record) {
-	if err := etchosts.Add(sb.config.hostsPath, recs); err != nil {
+	sb.updateDNSRecords(recs)
+
+	err := sb.writeHostsFile(func(path string) error {
+		if err := copyFile(sb.config.hostsPath, path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return etchosts.Add(path, recs)
+	})
+	if err != nil {
 		log.Warnf("Failed adding service host entries to the running container: %v", err)
 	}
 }
 
 func (sb *sandbox) deleteHostsEntries(recs []etchosts.Record) {
-	if err := etchosts.Delete(sb.config.hostsPath, recs); err != nil {
+	sb.removeDNSRecords(recs)
+
+	err := sb.writeHostsFile(func(path string) error {
+		if err := copyFile(sb.config.hostsPath, path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return etchosts.Delete(path, recs)
+	})
+	if err != nil {
 		log.Warnf("Failed deleting service host entries to the running container: %v", err)
 	}
 }
@@ -406,6 +612,7 @@ func (sb *sandbox) setupDNS() error {
 	}
 	dnsList := resolvconf.GetNameservers(resolvConf)
 	dnsSearchList := resolvconf.GetSearchDomains(resolvConf)
+	dnsOptionsList := sb.config.dnsOptionsList
 
 	if len(sb.config.dnsList) > 0 || len(sb.config.dnsSearchList) > 0 {
 		if len(sb.config.dnsList) > 0 {
@@ -416,7 +623,17 @@ func (sb *sandbox) setupDNS() error {
 		}
 	}
 
-	hash, err := resolvconf.Build(sb.config.resolvConfPath, dnsList, dnsSearchList)
+	// Service discovery is only meaningful for sandboxes that own their
+	// own network namespace; the default/host sandbox keeps the host's
+	// resolv.conf untouched.
+	if !sb.config.useDefaultSandBox {
+		if err := sb.setupResolver(dnsList); err != nil {
+			return err
+		}
+		dnsList = []string{resolverIPSandbox}
+	}
+
+	hash, err := resolvconf.Build(sb.config.resolvConfPath, dnsList, dnsSearchList, dnsOptionsList)
 	if err != nil {
 		return err
 	}
@@ -429,6 +646,68 @@ func (sb *sandbox) setupDNS() error {
 	return nil
 }
 
+// setupResolver starts the DNS resolver and installs the netns-local NAT
+// rules that redirect traffic bound for resolverIPSandbox:53 to the
+// resolver's listening socket, regardless of which interface the query
+// arrives on. libnetwork always installs those redirect rules itself, so
+// whichever Resolver is in play — the default in-process one, or a custom
+// implementation supplied via OptionResolver — is responsible for binding
+// and owning the 127.0.0.11:53 socket inside the sandbox's network
+// namespace in its own Start method; that's the only way it can receive
+// the redirected traffic. extServers are the upstream nameservers the
+// resolver proxies to: the container's own servers when set with OptionDNS,
+// otherwise the host's, captured before resolv.conf inside the sandbox is
+// rewritten to point solely at the resolver.
+func (sb *sandbox) setupResolver(extServers []string) error {
+	sb.Lock()
+	if sb.resolver == nil {
+		sb.resolver = NewResolver(sb)
+	}
+	resolver := sb.resolver
+	sb.Unlock()
+
+	resolver.SetExtServers(extServers)
+
+	if err := resolver.Start(); err != nil {
+		return fmt.Errorf("failed to start internal DNS resolver for sandbox %s: %v", sb.ID(), err)
+	}
+
+	if err := sb.osSbox.InvokeFunc(setupDNSRedirectRules); err != nil {
+		resolver.Stop()
+		return fmt.Errorf("failed to install DNS redirect rules for sandbox %s: %v", sb.ID(), err)
+	}
+
+	return nil
+}
+
+// setupDNSRedirectRules runs inside the sandbox's network namespace and
+// redirects any traffic destined to resolverIPSandbox:53 to the loopback
+// socket the embedded resolver is listening on. It is idempotent: a rule
+// already present (e.g. left over from before a live-restore, where the
+// netns and its iptables rules survive the daemon restart) is left alone
+// instead of being inserted again, so repeated restores don't accumulate
+// duplicate REDIRECT rules.
+func setupDNSRedirectRules() {
+	rules := [][]string{
+		{"-t", "nat", "-I", "OUTPUT", "-d", resolverIPSandbox, "-p", "udp", "--dport", dnsPort, "-j", "REDIRECT", "--to-port", dnsPort},
+		{"-t", "nat", "-I", "OUTPUT", "-d", resolverIPSandbox, "-p", "tcp", "--dport", dnsPort, "-j", "REDIRECT", "--to-port", dnsPort},
+	}
+
+	for _, rule := range rules {
+		checkRule := append([]string{"-t", "nat", "-C"}, rule[3:]...)
+		if _, err := iptables.Raw(checkRule...); err == nil {
+			// Rule already present, nothing to do.
+			continue
+		}
+
+		if output, err := iptables.Raw(rule...); err != nil {
+			log.Errorf("failed to set up DNS redirect rule %v: %v", rule, err)
+		} else if len(output) > 0 {
+			log.Errorf("failed to set up DNS redirect rule %v: %s", rule, output)
+		}
+	}
+}
+
 func (sb *sandbox) updateDNS(ipv6Enabled bool) error {
 	var oldHash []byte
 	hashFile := sb.config.resolvConfHashFile
@@ -580,6 +859,32 @@ func OptionDNSSearch(search string) SandboxOption {
 	}
 }
 
+// OptionDNSOptions function returns an option setter for dns options entry
+// to be passed to container Create method. The options are written as
+// "options ..." lines in the generated resolv.conf, alongside the entries
+// from OptionDNS and OptionDNSSearch.
+func OptionDNSOptions(options []string) SandboxOption {
+	return func(sb *sandbox) {
+		sb.config.dnsOptionsList = append(sb.config.dnsOptionsList, options...)
+	}
+}
+
+// OptionResolver function returns an option setter for a custom DNS
+// resolver backend to be passed to net container methods. The supplied
+// Resolver is started in place of the default in-process resolver when the
+// sandbox sets up its embedded DNS. libnetwork installs the iptables
+// redirect that sends traffic for 127.0.0.11:53 to that socket, but it is
+// the Resolver implementation's own responsibility, in Start, to bind and
+// own 127.0.0.11:53 inside the sandbox's network namespace; only then can
+// it receive the redirected queries and apply whatever logic it wants on
+// top, for example consulting an external service registry, applying
+// split-horizon rules, or enforcing DNSSEC.
+func OptionResolver(r Resolver) SandboxOption {
+	return func(sb *sandbox) {
+		sb.resolver = r
+	}
+}
+
 // OptionUseDefaultSandbox function returns an option setter for using default sandbox to
 // be passed to container Create method.
 func OptionUseDefaultSandbox() SandboxOption {
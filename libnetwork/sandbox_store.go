@@ -0,0 +1,370 @@
+package libnetwork
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/config"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/osl"
+)
+
+const sandboxPrefix = "sandbox"
+
+// epState is the minimal, persistable view of an endpoint attached to a
+// sandbox: enough to look the endpoint back up in the datastore on restore.
+type epState struct {
+	Nid string
+	Eid string
+}
+
+// extraHostState is the exported, persistable mirror of extraHost.
+type extraHostState struct {
+	Name string
+	IP   string
+}
+
+// sbState is the durable, on-disk representation of a sandbox. It is kept
+// separate from sandbox itself so that the in-memory type can carry live
+// handles (osl.Sandbox, *controller, sync.Mutex, ...) that have no business
+// being serialized.
+type sbState struct {
+	ID         string
+	Cid        string
+	c          *controller
+	dbIndex    uint64
+	dbExists   bool
+	Eps        []epState
+	EpPriority map[string]int
+	// ExtDNS records the upstream nameservers the embedded resolver proxies
+	// to (the container's OptionDNS servers, otherwise the host's), so a
+	// restored sandbox can resume proxying. It is only recorded for the
+	// default in-process resolver.
+	ExtDNS []string
+
+	// The fields below mirror sandbox.config (containerConfig) so that a
+	// warm restart restores the same hosts/resolv.conf behavior the
+	// sandbox was created with, not just its endpoint membership.
+	UseDefaultSandbox    bool
+	HostName             string
+	DomainName           string
+	HostsPath            string
+	OriginHostsPath      string
+	ExtraHosts           []extraHostState
+	ResolvConfPath       string
+	OriginResolvConfPath string
+	DNSList              []string
+	DNSSearchList        []string
+	DNSOptionsList       []string
+}
+
+func (sbs *sbState) Key() []string {
+	return []string{sandboxPrefix, sbs.ID}
+}
+
+func (sbs *sbState) KeyPrefix() []string {
+	return []string{sandboxPrefix}
+}
+
+func (sbs *sbState) Value() []byte {
+	b, err := json.Marshal(sbs)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (sbs *sbState) SetValue(value []byte) error {
+	return json.Unmarshal(value, sbs)
+}
+
+func (sbs *sbState) Index() uint64 {
+	return sbs.dbIndex
+}
+
+func (sbs *sbState) SetIndex(index uint64) {
+	sbs.dbIndex = index
+	sbs.dbExists = true
+}
+
+func (sbs *sbState) Exists() bool {
+	return sbs.dbExists
+}
+
+func (sbs *sbState) Skip() bool {
+	return false
+}
+
+func (sbs *sbState) New() datastore.KVObject {
+	return &sbState{c: sbs.c}
+}
+
+func (sbs *sbState) CopyTo(o datastore.KVObject) error {
+	dstSbs := o.(*sbState)
+	dstSbs.ID = sbs.ID
+	dstSbs.Cid = sbs.Cid
+	dstSbs.c = sbs.c
+	dstSbs.dbIndex = sbs.dbIndex
+	dstSbs.dbExists = sbs.dbExists
+	dstSbs.Eps = append([]epState(nil), sbs.Eps...)
+	dstSbs.ExtDNS = append([]string(nil), sbs.ExtDNS...)
+	dstSbs.EpPriority = make(map[string]int, len(sbs.EpPriority))
+	for k, v := range sbs.EpPriority {
+		dstSbs.EpPriority[k] = v
+	}
+	dstSbs.UseDefaultSandbox = sbs.UseDefaultSandbox
+	dstSbs.HostName = sbs.HostName
+	dstSbs.DomainName = sbs.DomainName
+	dstSbs.HostsPath = sbs.HostsPath
+	dstSbs.OriginHostsPath = sbs.OriginHostsPath
+	dstSbs.ExtraHosts = append([]extraHostState(nil), sbs.ExtraHosts...)
+	dstSbs.ResolvConfPath = sbs.ResolvConfPath
+	dstSbs.OriginResolvConfPath = sbs.OriginResolvConfPath
+	dstSbs.DNSList = append([]string(nil), sbs.DNSList...)
+	dstSbs.DNSSearchList = append([]string(nil), sbs.DNSSearchList...)
+	dstSbs.DNSOptionsList = append([]string(nil), sbs.DNSOptionsList...)
+	return nil
+}
+
+func (sbs *sbState) DataScope() string {
+	return datastore.LocalScope
+}
+
+// toSbState snapshots sb's durable fields into a sbState suitable for
+// persisting to the datastore.
+func (sb *sandbox) toSbState() *sbState {
+	sb.Lock()
+	defer sb.Unlock()
+
+	sbs := &sbState{
+		ID:                   sb.id,
+		Cid:                  sb.containerID,
+		c:                    sb.controller,
+		EpPriority:           make(map[string]int, len(sb.epPriority)),
+		UseDefaultSandbox:    sb.config.useDefaultSandBox,
+		HostName:             sb.config.hostName,
+		DomainName:           sb.config.domainName,
+		HostsPath:            sb.config.hostsPath,
+		OriginHostsPath:      sb.config.originHostsPath,
+		ResolvConfPath:       sb.config.resolvConfPath,
+		OriginResolvConfPath: sb.config.originResolvConfPath,
+		DNSList:              append([]string(nil), sb.config.dnsList...),
+		DNSSearchList:        append([]string(nil), sb.config.dnsSearchList...),
+		DNSOptionsList:       append([]string(nil), sb.config.dnsOptionsList...),
+	}
+	for _, eh := range sb.config.extraHosts {
+		sbs.ExtraHosts = append(sbs.ExtraHosts, extraHostState{Name: eh.name, IP: eh.IP})
+	}
+	for eid, prio := range sb.epPriority {
+		sbs.EpPriority[eid] = prio
+	}
+	for _, ep := range sb.endpoints {
+		sbs.Eps = append(sbs.Eps, epState{Nid: ep.getNetwork().ID(), Eid: ep.ID()})
+	}
+	if sb.resolver != nil {
+		if r, ok := sb.resolver.(*resolver); ok {
+			sbs.ExtDNS = r.extServers()
+		}
+	}
+	return sbs
+}
+
+// storeUpdate persists sb's current state to the controller's datastore.
+// It is called whenever populateNetworkResources, clearNetworkResources or
+// an option-mutating path changes a sandbox's durable state, so that a
+// live-restored daemon can reconstruct the sandbox from disk.
+func (sb *sandbox) storeUpdate() error {
+	store := sb.controller.getStore(datastore.LocalScope)
+	if store == nil {
+		return nil
+	}
+
+	if err := store.PutObjectAtomic(sb.toSbState()); err != nil {
+		return fmt.Errorf("failed to update store state of sandbox %s: %v", sb.ID(), err)
+	}
+	return nil
+}
+
+// deleteStoreState removes sb's persisted state from the controller's
+// datastore. It is called on sandbox Delete so a live-restore never finds
+// a stale record for a sandbox id that no longer exists.
+func (sb *sandbox) deleteStoreState() error {
+	store := sb.controller.getStore(datastore.LocalScope)
+	if store == nil {
+		return nil
+	}
+
+	sbs := sb.toSbState()
+	if err := store.GetObject(datastore.Key(sbs.Key()...), sbs); err != nil {
+		if err == datastore.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+
+	if err := store.DeleteObjectAtomic(sbs); err != nil {
+		return fmt.Errorf("failed to delete store state of sandbox %s: %v", sb.ID(), err)
+	}
+	return nil
+}
+
+// restoreSandbox reconnects libnetwork to a sandbox whose network namespace
+// is still alive in the kernel after a live-restore of the docker daemon.
+// activeEndpoints lists the endpoint IDs the caller has confirmed are still
+// attached; everything else persisted for id is rebuilt from the datastore
+// without touching interfaces that are already present in the namespace.
+func (c *controller) restoreSandbox(id string, activeEndpoints []string) (Sandbox, error) {
+	store := c.getStore(datastore.LocalScope)
+	if store == nil {
+		return nil, fmt.Errorf("no local datastore configured, cannot restore sandbox %s", id)
+	}
+
+	sbs := &sbState{ID: id, c: c}
+	if err := store.GetObject(datastore.Key(sbs.Key()...), sbs); err != nil {
+		return nil, fmt.Errorf("could not find persisted state for sandbox %s: %v", id, err)
+	}
+
+	sb := &sandbox{
+		id:            sbs.ID,
+		containerID:   sbs.Cid,
+		controller:    c,
+		epPriority:    sbs.EpPriority,
+		joinLeaveDone: make(chan struct{}),
+		config: containerConfig{
+			hostsPathConfig: hostsPathConfig{
+				hostName:        sbs.HostName,
+				domainName:      sbs.DomainName,
+				hostsPath:       sbs.HostsPath,
+				originHostsPath: sbs.OriginHostsPath,
+			},
+			resolvConfPathConfig: resolvConfPathConfig{
+				resolvConfPath:       sbs.ResolvConfPath,
+				originResolvConfPath: sbs.OriginResolvConfPath,
+				dnsList:              sbs.DNSList,
+				dnsSearchList:        sbs.DNSSearchList,
+				dnsOptionsList:       sbs.DNSOptionsList,
+			},
+			useDefaultSandBox: sbs.UseDefaultSandbox,
+		},
+	}
+	// hostsPathHashFile/resolvConfHashFile aren't persisted themselves;
+	// they're derived from the path they guard, the same way
+	// buildHostsFile/setupDNS compute them on first use.
+	if sb.config.hostsPath != "" {
+		sb.config.hostsPathHashFile = sb.config.hostsPath + ".hash"
+	}
+	if sb.config.resolvConfPath != "" {
+		sb.config.resolvConfHashFile = sb.config.resolvConfPath + ".hash"
+	}
+	for _, eh := range sbs.ExtraHosts {
+		sb.config.extraHosts = append(sb.config.extraHosts, extraHost{name: eh.Name, IP: eh.IP})
+	}
+	if sb.epPriority == nil {
+		sb.epPriority = make(map[string]int)
+	}
+
+	osSbox, err := osl.GetSandboxForExternalKey(sb.Key(), sb.Key())
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-attach to sandbox namespace for %s: %v", id, err)
+	}
+	sb.osSbox = osSbox
+
+	active := make(map[string]bool, len(activeEndpoints))
+	for _, eid := range activeEndpoints {
+		active[eid] = true
+	}
+
+	for _, eps := range sbs.Eps {
+		if !active[eps.Eid] {
+			log.Debugf("Skipping restore of endpoint %s for sandbox %s, no longer active", eps.Eid, id)
+			continue
+		}
+		n, err := c.NetworkByID(eps.Nid)
+		if err != nil {
+			log.Warnf("Could not find network %s while restoring sandbox %s: %v", eps.Nid, id, err)
+			continue
+		}
+		ep, err := n.EndpointByID(eps.Eid)
+		if err != nil {
+			log.Warnf("Could not find endpoint %s while restoring sandbox %s: %v", eps.Eid, id, err)
+			continue
+		}
+		epp, ok := ep.(*endpoint)
+		if !ok {
+			continue
+		}
+		epp.Lock()
+		epp.sandboxID = sb.id
+		epp.Unlock()
+		sb.Lock()
+		heap.Push(&sb.endpoints, epp)
+		sb.Unlock()
+	}
+
+	if len(sb.endpoints) > 0 {
+		if err := sb.updateGateway(sb.endpoints[0]); err != nil {
+			log.Warnf("Failed to reconcile gateway state for restored sandbox %s: %v", id, err)
+		}
+	}
+
+	if len(sb.endpoints) > 0 && len(sbs.ExtDNS) > 0 {
+		// The default in-process resolver is re-opened only for a sandbox
+		// with active endpoints and recorded upstream servers. A Resolver
+		// set via OptionResolver cannot be serialized and has no upstream
+		// servers recorded, so a sandbox that ran one comes back without
+		// a resolver.
+		log.Debugf("Restoring sandbox %s with the default embedded resolver; any custom OptionResolver must be reapplied by the caller", id)
+		if err := sb.setupResolver(sbs.ExtDNS); err != nil {
+			log.Warnf("Failed to re-open embedded resolver for restored sandbox %s: %v", id, err)
+		}
+	}
+
+	c.Lock()
+	c.sandboxes[sb.id] = sb
+	c.Unlock()
+
+	return sb, nil
+}
+
+// applyActiveSandboxes tells libnetwork which network namespaces created by
+// a previous run of the daemon are still alive in the kernel, so they can
+// be restored instead of torn down and recreated. It is consulted once, on
+// controller startup after a live-restore.
+func (c *controller) applyActiveSandboxes(active config.ActiveSandboxes) {
+	for id, eps := range active {
+		activeEndpoints, err := activeEndpointIDs(eps)
+		if err != nil {
+			log.Warnf("Could not parse active endpoint list for sandbox %s, treating as empty: %v", id, err)
+		}
+		if _, err := c.restoreSandbox(id, activeEndpoints); err != nil {
+			log.Warnf("Could not restore sandbox %s on startup: %v", id, err)
+		}
+	}
+}
+
+// activeEndpointIDs normalizes the per-sandbox value carried by
+// config.ActiveSandboxes into a list of endpoint IDs. The value is typed
+// interface{} because it is commonly decoded from daemon config/JSON,
+// where a list decodes as []interface{} rather than []string; accept both
+// instead of silently discarding a mismatched type, which would otherwise
+// make restoreSandbox treat every endpoint as inactive and detach it.
+func activeEndpointIDs(eps interface{}) ([]string, error) {
+	switch v := eps.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		ids := make([]string, 0, len(v))
+		for _, e := range v {
+			id, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("active endpoint id %v is not a string", e)
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	default:
+		return nil, fmt.Errorf("unsupported active endpoint list type %T", eps)
+	}
+}
@@ -0,0 +1,117 @@
+package libnetwork
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/libnetwork/config"
+)
+
+// optionBoltdbWithRandomDBFile returns config options that point the
+// controller at a throwaway boltdb file, so storeUpdate/restoreSandbox can
+// be exercised against a real on-disk datastore instead of a hand-built
+// sbState.
+func optionBoltdbWithRandomDBFile(t *testing.T) []config.Option {
+	tmp, err := ioutil.TempFile("", "libnetwork-sandbox-store-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp db file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatalf("failed to close temp db file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(tmp.Name()) })
+
+	return []config.Option{
+		config.OptionKVProvider("boltdb"),
+		config.OptionKVProviderURL(tmp.Name()),
+	}
+}
+
+// TestSandboxStoreRestore exercises the real persistence path end to end:
+// create a sandbox under a controller backed by a throwaway boltdb store,
+// persist it via storeUpdate, discard the in-memory controller and
+// sandbox entirely, and reconstruct a working sandbox purely from what was
+// persisted to disk via controller.restoreSandbox.
+func TestSandboxStoreRestore(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("skipping test that requires root to create a network namespace")
+	}
+
+	cfgOptions := optionBoltdbWithRandomDBFile(t)
+
+	ctrl, err := New(cfgOptions...)
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	c := ctrl.(*controller)
+
+	sb := &sandbox{
+		id:            "sandbox1",
+		containerID:   "container1",
+		controller:    c,
+		epPriority:    map[string]int{"ep1": 5},
+		joinLeaveDone: make(chan struct{}),
+		config: containerConfig{
+			hostsPathConfig: hostsPathConfig{
+				hostName:   "test-host",
+				domainName: "example.com",
+				hostsPath:  "/var/lib/docker/network/files/sandbox1/hosts",
+				extraHosts: []extraHost{{name: "peer", IP: "10.0.0.2"}},
+			},
+			resolvConfPathConfig: resolvConfPathConfig{
+				resolvConfPath: "/var/lib/docker/network/files/sandbox1/resolv.conf",
+				dnsList:        []string{"8.8.8.8"},
+				dnsSearchList:  []string{"example.com"},
+				dnsOptionsList: []string{"ndots:0"},
+			},
+		},
+	}
+	sb.config.hostsPathHashFile = sb.config.hostsPath + ".hash"
+	sb.config.resolvConfHashFile = sb.config.resolvConfPath + ".hash"
+
+	c.Lock()
+	c.sandboxes[sb.id] = sb
+	c.Unlock()
+
+	if err := sb.storeUpdate(); err != nil {
+		t.Fatalf("failed to persist sandbox state: %v", err)
+	}
+
+	// Discard the in-memory controller and sandbox entirely, then rebuild
+	// a fresh controller against the same on-disk store, simulating a
+	// daemon restart.
+	ctrl, sb = nil, nil
+
+	ctrl2, err := New(cfgOptions...)
+	if err != nil {
+		t.Fatalf("failed to recreate controller: %v", err)
+	}
+	c2 := ctrl2.(*controller)
+
+	restored, err := c2.restoreSandbox("sandbox1", nil)
+	if err != nil {
+		t.Fatalf("failed to restore sandbox from disk: %v", err)
+	}
+
+	rsb, ok := restored.(*sandbox)
+	if !ok {
+		t.Fatalf("restoreSandbox returned unexpected type %T", restored)
+	}
+
+	if rsb.config.hostName != "test-host" {
+		t.Fatalf("expected host name %q, got %q", "test-host", rsb.config.hostName)
+	}
+	if rsb.config.hostsPathHashFile != rsb.config.hostsPath+".hash" {
+		t.Fatalf("expected hosts hash file to be recomputed from the restored hosts path, got %q", rsb.config.hostsPathHashFile)
+	}
+	if rsb.config.resolvConfHashFile != rsb.config.resolvConfPath+".hash" {
+		t.Fatalf("expected resolv.conf hash file to be recomputed from the restored resolv.conf path, got %q", rsb.config.resolvConfHashFile)
+	}
+	if len(rsb.config.extraHosts) != 1 || rsb.config.extraHosts[0].name != "peer" {
+		t.Fatalf("expected extra host peer to survive the restore, got %+v", rsb.config.extraHosts)
+	}
+	if rsb.epPriority["ep1"] != 5 {
+		t.Fatalf("expected endpoint priority 5 for ep1, got %d", rsb.epPriority["ep1"])
+	}
+}